@@ -0,0 +1,88 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package sidecar
+
+import (
+	"reflect"
+
+	"tkestack.io/kvass/pkg/target"
+)
+
+// targetDiff is the result of comparing two full target maps, split into
+// targets that are new, gone, or changed since the last applied update.
+type targetDiff struct {
+	added    map[string][]*target.Target
+	removed  map[string][]*target.Target
+	modified map[string][]*target.Target
+}
+
+// empty reports whether the diff carries no changes at all.
+func (d *targetDiff) empty() bool {
+	return len(d.added) == 0 && len(d.removed) == 0 && len(d.modified) == 0
+}
+
+// diffTargets compares the previously applied targets (old) against the
+// newly received ones (cur), keyed by job and target.Hash.
+func diffTargets(old, cur map[string][]*target.Target) *targetDiff {
+	diff := &targetDiff{
+		added:    map[string][]*target.Target{},
+		removed:  map[string][]*target.Target{},
+		modified: map[string][]*target.Target{},
+	}
+
+	for job, curTs := range cur {
+		oldByHash := indexTargetsByHash(old[job])
+		for _, ct := range curTs {
+			ot, exists := oldByHash[ct.Hash]
+			switch {
+			case !exists:
+				diff.added[job] = append(diff.added[job], ct)
+			case !reflect.DeepEqual(ot, ct):
+				diff.modified[job] = append(diff.modified[job], ct)
+			}
+		}
+	}
+
+	for job, oldTs := range old {
+		curByHash := indexTargetsByHash(cur[job])
+		for _, ot := range oldTs {
+			if _, exists := curByHash[ot.Hash]; !exists {
+				diff.removed[job] = append(diff.removed[job], ot)
+			}
+		}
+	}
+
+	return diff
+}
+
+func indexTargetsByHash(ts []*target.Target) map[uint64]*target.Target {
+	m := make(map[uint64]*target.Target, len(ts))
+	for _, t := range ts {
+		m[t.Hash] = t
+	}
+	return m
+}
+
+// countTargets sums the number of targets across all jobs in m.
+func countTargets(m map[string][]*target.Target) int {
+	n := 0
+	for _, ts := range m {
+		n += len(ts)
+	}
+	return n
+}
@@ -0,0 +1,67 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package sidecar
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// nativeHistogramOpts builds HistogramOpts that emit a Prometheus native
+// (sparse) histogram alongside classicBuckets as the always-present classic
+// bucketing, so scrapers and rule evaluators that don't understand native
+// histograms still get a usable series.
+func nativeHistogramOpts(name, help string, classicBuckets []float64) prometheus.HistogramOpts {
+	return prometheus.HistogramOpts{
+		Name:                            name,
+		Help:                            help,
+		Buckets:                         classicBuckets,
+		NativeHistogramBucketFactor:     1.1,
+		NativeHistogramMaxBucketNumber:  100,
+		NativeHistogramMinResetDuration: time.Hour,
+	}
+}
+
+var (
+	// targetsDiffSize tracks how many targets were added/removed/modified by
+	// a single UpdateTargets call, split by the "type" label.
+	targetsDiffSize = prometheus.NewHistogramVec(
+		nativeHistogramOpts(
+			"kvass_sidecar_targets_diff_size",
+			"number of targets added/removed/modified by an update, by type",
+			prometheus.ExponentialBuckets(1, 2, 10),
+		), []string{"type"})
+
+	// callbackDuration tracks how long doCallbacks takes to run all
+	// registered update callbacks.
+	callbackDuration = prometheus.NewHistogramVec(
+		nativeHistogramOpts(
+			"kvass_sidecar_targets_callback_duration_seconds",
+			"time spent running update callbacks",
+			prometheus.DefBuckets,
+		), []string{})
+
+	// storeCorruptionTotal counts how many times a TargetsStore detected a
+	// corrupt store file (checksum mismatch) and had to fall back to a
+	// backup copy.
+	storeCorruptionTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kvass_sidecar_store_corruption_total",
+		Help: "number of times the shard store was found corrupted on load",
+	}, []string{})
+)
@@ -0,0 +1,44 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package sidecar
+
+import (
+	"context"
+)
+
+// TargetsStore is the persistence backend used by TargetsManager to load and
+// save a shard's TargetsInfo. Implementations are free to choose how and
+// where the data actually lives: a local file, a remote KV store shared by
+// HA sidecar replicas, or a Kubernetes object watched by a controller.
+type TargetsStore interface {
+	// Load returns the last persisted TargetsInfo. Implementations must
+	// return an empty TargetsInfo, not an error, when nothing has been
+	// saved yet so a fresh shard can start empty.
+	Load(ctx context.Context) (TargetsInfo, error)
+	// Save persists info, overwriting whatever was stored before.
+	Save(ctx context.Context, info TargetsInfo) error
+	// Watch streams a TargetsInfo every time the backend observes a change
+	// to the stored data, for example another sidecar replica taking over
+	// the shard, or an operator editing the backing object directly.
+	// Whether writes made by this process's own Save are streamed as well
+	// depends on the implementation. Implementations that can't watch for
+	// changes may return a nil channel.
+	//
+	// The returned channel is closed when ctx is canceled.
+	Watch(ctx context.Context) <-chan TargetsInfo
+}
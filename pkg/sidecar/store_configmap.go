@@ -0,0 +1,169 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package sidecar
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// targetsInfoConfigMapKey is the data key the TargetsInfo JSON blob is
+// stored under inside the ConfigMap.
+const targetsInfoConfigMapKey = "targets.json"
+
+// ConfigMapStore is a TargetsStore backed by a Kubernetes ConfigMap, one per
+// shard. It relies on the ConfigMap's resourceVersion for optimistic
+// concurrency: Save always updates the object it last read, so a write based
+// on stale data is rejected by the API server instead of silently
+// overwriting a concurrent writer.
+type ConfigMapStore struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+
+	// mu guards lastResourceVersion, which Load/Save and the Watch
+	// goroutine all read and write from whatever goroutine calls them.
+	mu                  sync.Mutex
+	lastResourceVersion string
+}
+
+func (s *ConfigMapStore) getResourceVersion() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastResourceVersion
+}
+
+func (s *ConfigMapStore) setResourceVersion(v string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastResourceVersion = v
+}
+
+// NewConfigMapStore creates a ConfigMapStore for the ConfigMap name in
+// namespace, using client to talk to the API server.
+func NewConfigMapStore(client kubernetes.Interface, namespace, name string) *ConfigMapStore {
+	return &ConfigMapStore{client: client, namespace: namespace, name: name}
+}
+
+// Load implements TargetsStore.
+func (s *ConfigMapStore) Load(ctx context.Context) (TargetsInfo, error) {
+	info := newTargetsInfo()
+
+	cm, err := s.client.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return info, nil
+		}
+		return info, errors.Wrapf(err, "get configmap %s/%s", s.namespace, s.name)
+	}
+
+	s.setResourceVersion(cm.ResourceVersion)
+	data := cm.Data[targetsInfoConfigMapKey]
+	if data == "" {
+		return info, nil
+	}
+
+	if err := json.Unmarshal([]byte(data), &info); err != nil {
+		return info, errors.Wrapf(err, "unmarshal configmap %s/%s", s.namespace, s.name)
+	}
+	return info, nil
+}
+
+// Save implements TargetsStore. It creates the ConfigMap if it doesn't exist
+// yet, otherwise it updates it carrying forward the resourceVersion observed
+// by the last Load/Save, so a write racing against another owner of the same
+// ConfigMap fails with a conflict instead of clobbering it.
+func (s *ConfigMapStore) Save(ctx context.Context, info TargetsInfo) error {
+	data, err := json.Marshal(&info)
+	if err != nil {
+		return errors.Wrap(err, "marshal targets info")
+	}
+
+	cms := s.client.CoreV1().ConfigMaps(s.namespace)
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            s.name,
+			Namespace:       s.namespace,
+			ResourceVersion: s.getResourceVersion(),
+		},
+		Data: map[string]string{targetsInfoConfigMapKey: string(data)},
+	}
+
+	if cm.ResourceVersion == "" {
+		created, err := cms.Create(ctx, cm, metav1.CreateOptions{})
+		if err != nil {
+			return errors.Wrapf(err, "create configmap %s/%s", s.namespace, s.name)
+		}
+		s.setResourceVersion(created.ResourceVersion)
+		return nil
+	}
+
+	updated, err := cms.Update(ctx, cm, metav1.UpdateOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "update configmap %s/%s", s.namespace, s.name)
+	}
+	s.setResourceVersion(updated.ResourceVersion)
+	return nil
+}
+
+// Watch implements TargetsStore, streaming the decoded TargetsInfo whenever
+// the ConfigMap is modified by someone other than this process.
+func (s *ConfigMapStore) Watch(ctx context.Context) <-chan TargetsInfo {
+	ch := make(chan TargetsInfo)
+	go func() {
+		defer close(ch)
+
+		w, err := s.client.CoreV1().ConfigMaps(s.namespace).Watch(ctx, metav1.ListOptions{
+			FieldSelector: "metadata.name=" + s.name,
+		})
+		if err != nil {
+			return
+		}
+		defer w.Stop()
+
+		for event := range w.ResultChan() {
+			cm, ok := event.Object.(*corev1.ConfigMap)
+			if !ok {
+				continue
+			}
+			if cm.ResourceVersion == s.getResourceVersion() {
+				continue
+			}
+
+			info := newTargetsInfo()
+			if err := json.Unmarshal([]byte(cm.Data[targetsInfoConfigMapKey]), &info); err != nil {
+				continue
+			}
+			s.setResourceVersion(cm.ResourceVersion)
+
+			select {
+			case ch <- info:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
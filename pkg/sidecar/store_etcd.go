@@ -0,0 +1,126 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package sidecar
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/clientv3/concurrency"
+)
+
+// defaultEtcdLeaseTTL is how long an EtcdStore's ownership lease lives
+// without being refreshed. It must be long enough to survive a GC pause but
+// short enough that a crashed sidecar's lock is released quickly.
+const defaultEtcdLeaseTTL = 10
+
+// EtcdStore is a TargetsStore backed by an etcd (or Consul, via its etcd v3
+// gRPC gateway) key. It is meant for HA deployments where two sidecar
+// replicas could be started for the same shard during a rolling restart:
+// each Save holds an exclusive, lease-bound lock on the key while it writes,
+// so writes from two replicas never interleave. The lock is released when
+// Save returns; it gives no replica lasting ownership of the shard, and a
+// later Save from another replica still overwrites the stored data.
+type EtcdStore struct {
+	client *clientv3.Client
+	key    string
+	ttl    int
+}
+
+// NewEtcdStore creates an EtcdStore that stores the shard's TargetsInfo
+// under key in client. ttl is the lock lease TTL in seconds; pass 0 to use
+// defaultEtcdLeaseTTL.
+func NewEtcdStore(client *clientv3.Client, key string, ttl int) *EtcdStore {
+	if ttl <= 0 {
+		ttl = defaultEtcdLeaseTTL
+	}
+	return &EtcdStore{client: client, key: key, ttl: ttl}
+}
+
+// Load implements TargetsStore.
+func (s *EtcdStore) Load(ctx context.Context) (TargetsInfo, error) {
+	info := newTargetsInfo()
+
+	resp, err := s.client.Get(ctx, s.key)
+	if err != nil {
+		return info, errors.Wrapf(err, "get %s from etcd", s.key)
+	}
+	if len(resp.Kvs) == 0 {
+		return info, nil
+	}
+
+	if err := json.Unmarshal(resp.Kvs[0].Value, &info); err != nil {
+		return info, errors.Wrapf(err, "unmarshal %s", s.key)
+	}
+	return info, nil
+}
+
+// Save implements TargetsStore. It acquires the shard's ownership lock
+// before writing so a concurrent sidecar for the same shard can't interleave
+// a write of its own.
+func (s *EtcdStore) Save(ctx context.Context, info TargetsInfo) error {
+	session, err := concurrency.NewSession(s.client, concurrency.WithTTL(s.ttl))
+	if err != nil {
+		return errors.Wrap(err, "create etcd session")
+	}
+	defer session.Close()
+
+	mutex := concurrency.NewMutex(session, s.key+"/lock")
+	if err := mutex.Lock(ctx); err != nil {
+		return errors.Wrap(err, "acquire etcd lock")
+	}
+	defer func() { _ = mutex.Unlock(ctx) }()
+
+	data, err := json.Marshal(&info)
+	if err != nil {
+		return errors.Wrap(err, "marshal targets info")
+	}
+
+	if _, err := s.client.Put(ctx, s.key, string(data)); err != nil {
+		return errors.Wrapf(err, "put %s to etcd", s.key)
+	}
+	return nil
+}
+
+// Watch implements TargetsStore, streaming the decoded TargetsInfo on every
+// put to the key, including the puts made by this store's own Save.
+func (s *EtcdStore) Watch(ctx context.Context) <-chan TargetsInfo {
+	ch := make(chan TargetsInfo)
+	go func() {
+		defer close(ch)
+		for resp := range s.client.Watch(ctx, s.key) {
+			for _, ev := range resp.Events {
+				if ev.Type != clientv3.EventTypePut {
+					continue
+				}
+				info := newTargetsInfo()
+				if err := json.Unmarshal(ev.Kv.Value, &info); err != nil {
+					continue
+				}
+				select {
+				case ch <- info:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch
+}
@@ -0,0 +1,302 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package sidecar
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+var (
+	storeFileName           = "kvass-shard.json"
+	oldVersionStoreFileName = "targets.json"
+	backupFileSuffix        = ".bak"
+	tmpFileSuffix           = ".tmp"
+
+	// checksumSeparator delimits the checksum header from the JSON payload
+	// in a store file: "<hex sha256>\n<json>".
+	checksumSeparator = byte('\n')
+
+	// watchDebounce bounds how often a burst of filesystem events (e.g. the
+	// write-temp-then-rename sequence Save itself performs) turns into a
+	// TargetsInfo on the Watch channel.
+	watchDebounce = 500 * time.Millisecond
+)
+
+// FileStore is the default TargetsStore, keeping the shard's TargetsInfo in
+// a local file. It is the storage kvass has always used for a single sidecar
+// writing its own disk, and it transparently migrates data written by the
+// old "targets.json" format.
+//
+// Writes are crash-safe: the new content is written to a temp file, fsynced,
+// and only then renamed over the real store file, with the previous good
+// copy linked to a ".bak" file first so the real store file never stops
+// resolving to a valid inode mid-write. Reads verify a checksum embedded at
+// the top of the file and fall back to the ".bak" copy whenever the primary
+// is missing or fails that check.
+type FileStore struct {
+	storeDir string
+}
+
+// NewFileStore create a FileStore rooted at storeDir. It preserves the
+// historical behaviour of NewTargetsManager(storeDir, ...): the directory is
+// created if missing, and Load() falls back to the pre-kvass-shard.json
+// "targets.json" file when kvass-shard.json does not exist yet.
+func NewFileStore(storeDir string) *FileStore {
+	return &FileStore{storeDir: storeDir}
+}
+
+// Load implements TargetsStore.
+func (s *FileStore) Load(ctx context.Context) (TargetsInfo, error) {
+	_ = os.MkdirAll(s.storeDir, 0755)
+
+	info, err := s.loadChecked(s.storePath())
+	if err == nil {
+		return info, nil
+	}
+	if os.IsNotExist(err) {
+		if backup, backupErr := s.loadChecked(s.backupPath()); backupErr == nil {
+			return backup, nil
+		}
+	} else {
+		storeCorruptionTotal.WithLabelValues().Inc()
+		backup, backupErr := s.loadChecked(s.backupPath())
+		if backupErr == nil {
+			return backup, nil
+		}
+		return info, errors.Wrapf(err, "load %s failed, backup also unusable: %v", storeFileName, backupErr)
+	}
+
+	// compatible old version
+	data, err := ioutil.ReadFile(path.Join(s.storeDir, oldVersionStoreFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return info, nil
+		}
+		return info, errors.Wrapf(err, "load %s failed", oldVersionStoreFileName)
+	}
+
+	if err := json.Unmarshal(data, &info.Targets); err != nil {
+		return info, errors.Wrapf(err, "marshal targets.json")
+	}
+
+	return info, nil
+}
+
+// loadChecked reads filePath, verifies its embedded checksum and unmarshals
+// the payload. A missing file is reported via os.IsNotExist on the error.
+func (s *FileStore) loadChecked(filePath string) (TargetsInfo, error) {
+	info := newTargetsInfo()
+
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return info, err
+	}
+
+	payload, err := verifyChecksum(data)
+	if err != nil {
+		return info, errors.Wrapf(err, "verify checksum of %s", filePath)
+	}
+
+	if err := json.Unmarshal(payload, &info); err != nil {
+		return info, errors.Wrapf(err, "marshal %s", filePath)
+	}
+	return info, nil
+}
+
+// Save implements TargetsStore using a write-temp, fsync, rename sequence so
+// a crash never leaves kvass-shard.json truncated or empty. The previous
+// good copy is hard-linked to kvass-shard.json.bak before the new one
+// replaces it, so kvass-shard.json itself is never briefly absent.
+func (s *FileStore) Save(ctx context.Context, info TargetsInfo) error {
+	data, err := json.Marshal(&info)
+	if err != nil {
+		return errors.Wrap(err, "marshal targets info")
+	}
+
+	tmpPath := s.storePath() + tmpFileSuffix
+	if err := writeFileSync(tmpPath, checksummedPayload(data)); err != nil {
+		return errors.Wrap(err, "write temp store file")
+	}
+
+	if _, err := os.Stat(s.storePath()); err == nil {
+		// Link (not rename) the current store file to the backup path, so
+		// kvass-shard.json keeps resolving to a valid inode for the entire
+		// sequence below: a crash before the final rename still leaves the
+		// old, readable content in place rather than a gap where neither
+		// path exists.
+		_ = os.Remove(s.backupPath())
+		if err := os.Link(s.storePath(), s.backupPath()); err != nil {
+			return errors.Wrap(err, "rotate backup store file")
+		}
+	}
+
+	if err := os.Rename(tmpPath, s.storePath()); err != nil {
+		return errors.Wrap(err, "rename temp store file into place")
+	}
+
+	return errors.Wrap(fsyncDir(s.storeDir), "fsync store dir")
+}
+
+// Watch implements TargetsStore using fsnotify, so an operator hand-editing
+// kvass-shard.json (or an external tool writing it via the same atomic
+// rename pattern as Save) is picked up without restarting the sidecar.
+// Events are debounced by watchDebounce so the rename-into-place a write
+// performs doesn't fan out into multiple reloads.
+func (s *FileStore) Watch(ctx context.Context) <-chan TargetsInfo {
+	ch := make(chan TargetsInfo)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		close(ch)
+		return ch
+	}
+	if err := watcher.Add(s.storeDir); err != nil {
+		_ = watcher.Close()
+		close(ch)
+		return ch
+	}
+
+	go func() {
+		defer close(ch)
+		defer watcher.Close()
+
+		timer := time.NewTimer(watchDebounce)
+		if !timer.Stop() {
+			<-timer.C
+		}
+		pending := false
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if path.Base(event.Name) != storeFileName {
+					continue
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				pending = true
+				timer.Reset(watchDebounce)
+
+			case _, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+
+			case <-timer.C:
+				if !pending {
+					continue
+				}
+				pending = false
+
+				info, err := s.loadChecked(s.storePath())
+				if err != nil {
+					continue
+				}
+				select {
+				case ch <- info:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return ch
+}
+
+func (s *FileStore) storePath() string {
+	return path.Join(s.storeDir, storeFileName)
+}
+
+func (s *FileStore) backupPath() string {
+	return s.storePath() + backupFileSuffix
+}
+
+// checksummedPayload prefixes data with a hex sha256 checksum header so a
+// truncated or bit-flipped read can be detected on load.
+func checksummedPayload(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	header := hex.EncodeToString(sum[:])
+	out := make([]byte, 0, len(header)+1+len(data))
+	out = append(out, header...)
+	out = append(out, checksumSeparator)
+	out = append(out, data...)
+	return out
+}
+
+// verifyChecksum splits off the checksum header written by
+// checksummedPayload, verifies it against the remaining payload and returns
+// that payload.
+func verifyChecksum(data []byte) ([]byte, error) {
+	idx := bytes.IndexByte(data, checksumSeparator)
+	if idx < 0 {
+		return nil, errors.New("missing checksum header")
+	}
+
+	header, payload := data[:idx], data[idx+1:]
+	sum := sha256.Sum256(payload)
+	if hex.EncodeToString(sum[:]) != string(header) {
+		return nil, errors.New("checksum mismatch")
+	}
+	return payload, nil
+}
+
+// writeFileSync writes data to filePath, fsyncing it before close so the
+// content is durable once the call returns.
+func writeFileSync(filePath string, data []byte) error {
+	f, err := os.OpenFile(filePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// fsyncDir fsyncs a directory so a rename of one of its entries is durable
+// across a crash, not just the renamed file itself.
+func fsyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
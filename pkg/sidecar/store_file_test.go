@@ -0,0 +1,116 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package sidecar
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStoreSaveLoadRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	s := NewFileStore(dir)
+
+	want := newTargetsInfo()
+	want.IdleAt = nil
+
+	require.NoError(t, s.Save(context.Background(), want))
+
+	got, err := s.Load(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, want.Targets, got.Targets)
+}
+
+// TestFileStoreLoad_BackupSurvivesPrimaryLoss simulates the primary store
+// file going missing while a ".bak" copy exists. It asserts Load still
+// recovers the last good content from the ".bak" copy instead of silently
+// falling through to the legacy, errorless empty store.
+func TestFileStoreLoad_BackupSurvivesPrimaryLoss(t *testing.T) {
+	dir := t.TempDir()
+	s := NewFileStore(dir)
+
+	first := newTargetsInfo()
+	require.NoError(t, s.Save(context.Background(), first))
+
+	// A second Save leaves kvass-shard.json.bak hard-linked to the content
+	// written by the first Save. Removing the primary afterwards leaves only
+	// that backup to load from.
+	require.NoError(t, s.Save(context.Background(), first))
+	require.NoError(t, os.Remove(s.storePath()))
+
+	got, err := s.Load(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, first.Targets, got.Targets)
+}
+
+// TestFileStoreLoad_ConcurrentExternalWriter simulates an external process
+// writing kvass-shard.json with the same write-temp-then-rename pattern
+// Save uses (the pattern Watch's doc comment says it supports), while Load
+// polls concurrently. Because the writer only ever renames a fully-written,
+// checksummed temp file into place, Load must always observe either the
+// previous or the next complete file and never an error.
+func TestFileStoreLoad_ConcurrentExternalWriter(t *testing.T) {
+	dir := t.TempDir()
+	s := NewFileStore(dir)
+
+	require.NoError(t, s.Save(context.Background(), newTargetsInfo()))
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			info := newTargetsInfo()
+			data, err := json.Marshal(&info)
+			if err != nil {
+				continue
+			}
+			tmp := path.Join(dir, "external.tmp")
+			_ = os.WriteFile(tmp, checksummedPayload(data), 0644)
+			_ = os.Rename(tmp, s.storePath())
+		}
+	}()
+
+	deadline := time.After(2 * time.Second)
+loop:
+	for {
+		select {
+		case <-deadline:
+			break loop
+		default:
+			_, err := s.Load(context.Background())
+			require.NoError(t, err)
+		}
+	}
+
+	close(stop)
+	<-done
+}
@@ -18,11 +18,9 @@
 package sidecar
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"io/ioutil"
-	"os"
-	"path"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -34,9 +32,7 @@ import (
 )
 
 var (
-	storeFileName           = "kvass-shard.json"
-	oldVersionStoreFileName = "targets.json"
-	timeNow                 = time.Now
+	timeNow = time.Now
 
 	targetsUpdatedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "kvass_sidecar_targets_updated_total",
@@ -67,77 +63,100 @@ func newTargetsInfo() TargetsInfo {
 
 // TargetsManager manager local targets of this shard
 type TargetsManager struct {
+	// mu guards targets against concurrent UpdateTargets calls. UpdateTargets
+	// is invoked both by the coordinator's push handler and, since Watch was
+	// added, by the store-watch/SIGHUP reload loop, so the read-modify-write
+	// of t.targets can no longer assume a single caller.
+	mu              sync.Mutex
 	targets         TargetsInfo
 	updateCallbacks []func(targets map[string][]*target.Target) error
-	storeDir        string
+	diffCallbacks   []func(added, removed, modified map[string][]*target.Target) error
+	store           TargetsStore
 	log             logrus.FieldLogger
 }
 
-// NewTargetsManager return a new target manager
-func NewTargetsManager(storeDir string, promRegistry prometheus.Registerer, log logrus.FieldLogger) *TargetsManager {
+// NewTargetsManager return a new target manager. store is the backend used
+// to persist and, where supported, watch the shard's TargetsInfo. Pass
+// NewFileStore(storeDir) to keep the historical local-file behaviour.
+func NewTargetsManager(store TargetsStore, promRegistry prometheus.Registerer, log logrus.FieldLogger) *TargetsManager {
 	_ = promRegistry.Register(targetsTotal)
 	_ = promRegistry.Register(targetsUpdatedTotal)
+	_ = promRegistry.Register(targetsDiffSize)
+	_ = promRegistry.Register(callbackDuration)
+	_ = promRegistry.Register(storeCorruptionTotal)
 	return &TargetsManager{
-		storeDir: storeDir,
-		log:      log,
-		targets:  newTargetsInfo(),
+		store:   store,
+		log:     log,
+		targets: newTargetsInfo(),
 	}
 }
 
-// Load load local targets information from storeDir
+// Load load local targets information from the configured TargetsStore
 func (t *TargetsManager) Load() error {
-	_ = os.MkdirAll(t.storeDir, 0755)
-	defer func() {
-		_ = t.UpdateTargets(&shard.UpdateTargetsRequest{Targets: t.targets.Targets})
-	}()
-
-	data, err := ioutil.ReadFile(t.storePath())
-	if err == nil {
-		if err := json.Unmarshal(data, &t.targets); err != nil {
-			return errors.Wrapf(err, "marshal %s", storeFileName)
-		}
-	} else {
-		if !os.IsNotExist(err) {
-			return errors.Wrapf(err, "load %s failed", storeFileName)
-		}
-		// compatible old version
-		data, err := ioutil.ReadFile(path.Join(t.storeDir, oldVersionStoreFileName))
-		if err != nil {
-			if os.IsNotExist(err) {
-				return nil
-			}
-			return errors.Wrapf(err, "load %s failed", oldVersionStoreFileName)
-		}
-
-		if err := json.Unmarshal(data, &t.targets.Targets); err != nil {
-			return errors.Wrapf(err, "marshal targets.json")
-		}
+	info, err := t.store.Load(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "load targets store")
 	}
-
-	return nil
+	// keep t.targets at its fresh, empty baseline so the UpdateTargets below
+	// diffs the loaded targets as all-added and runs callbacks for them on
+	// startup, but still carry over a pre-existing idle timestamp. A store
+	// holding no targets gives an empty diff, so no callbacks run then.
+	t.mu.Lock()
+	t.targets.IdleAt = info.IdleAt
+	t.mu.Unlock()
+
+	return t.UpdateTargets(&shard.UpdateTargetsRequest{Targets: info.Targets})
 }
 
-// AddUpdateCallbacks add a call back for targets updating event
+// AddUpdateCallbacks add a call back for targets updating event, invoked
+// with the full current target map on every non-empty update.
 func (t *TargetsManager) AddUpdateCallbacks(f ...func(targets map[string][]*target.Target) error) {
 	t.updateCallbacks = append(t.updateCallbacks, f...)
 }
 
-// UpdateTargets update local targets
+// AddUpdateDiffCallbacks add a callback invoked with only what changed since
+// the last update: targets added, removed and modified, keyed by job. This
+// lets consumers like a Prometheus config reload avoid re-processing
+// targets that didn't change.
+func (t *TargetsManager) AddUpdateDiffCallbacks(
+	f ...func(added, removed, modified map[string][]*target.Target) error) {
+	t.diffCallbacks = append(t.diffCallbacks, f...)
+}
+
+// UpdateTargets update local targets. Persistence and callbacks only run
+// when the new targets actually differ from what's currently applied,
+// keyed by job and target.Hash.
 func (t *TargetsManager) UpdateTargets(req *shard.UpdateTargetsRequest) (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
 	defer func() {
 		targetsUpdatedTotal.WithLabelValues(fmt.Sprint(err == nil)).Inc()
-		targetsTotal.WithLabelValues().Set(float64(len(t.targets.Status)))
 	}()
 
+	diff := diffTargets(t.targets.Targets, req.Targets)
+
 	t.targets.Targets = req.Targets
 	t.updateStatus()
 	t.updateIdleState()
+	targetsTotal.WithLabelValues().Set(float64(len(t.targets.Status)))
+
+	if diff.empty() {
+		return nil
+	}
+
+	targetsDiffSize.WithLabelValues("added").Observe(float64(countTargets(diff.added)))
+	targetsDiffSize.WithLabelValues("removed").Observe(float64(countTargets(diff.removed)))
+	targetsDiffSize.WithLabelValues("modified").Observe(float64(countTargets(diff.modified)))
 
-	if err := t.doCallbacks(); err != nil {
-		return errors.Wrapf(err, "do callbacks")
+	callbackStart := timeNow()
+	callbackErr := t.doCallbacks(diff)
+	callbackDuration.WithLabelValues().Observe(time.Since(callbackStart).Seconds())
+	if callbackErr != nil {
+		return errors.Wrapf(callbackErr, "do callbacks")
 	}
 
-	return errors.Wrapf(t.saveTargets(), "save targets to file")
+	return errors.Wrapf(t.store.Save(context.Background(), t.targets), "save targets to store")
 }
 
 func (t *TargetsManager) updateIdleState() {
@@ -170,28 +189,23 @@ func (t *TargetsManager) updateStatus() {
 	t.targets.Status = status
 }
 
-func (t *TargetsManager) doCallbacks() error {
+func (t *TargetsManager) doCallbacks(diff *targetDiff) error {
 	for _, call := range t.updateCallbacks {
 		if err := call(t.targets.Targets); err != nil {
 			return err
 		}
 	}
-	return nil
-}
-
-func (t *TargetsManager) saveTargets() error {
-	data, _ := json.Marshal(&t.targets)
-	if err := ioutil.WriteFile(t.storePath(), data, 0755); err != nil {
-		return err
+	for _, call := range t.diffCallbacks {
+		if err := call(diff.added, diff.removed, diff.modified); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func (t *TargetsManager) storePath() string {
-	return path.Join(t.storeDir, storeFileName)
-}
-
 // TargetsInfo return current targets of this shard
 func (t *TargetsManager) TargetsInfo() TargetsInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 	return t.targets
 }
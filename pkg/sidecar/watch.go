@@ -0,0 +1,75 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package sidecar
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"tkestack.io/kvass/pkg/shard"
+	"tkestack.io/kvass/pkg/target"
+)
+
+// Watch observes the configured TargetsStore for changes (an operator
+// hand-editing the store file during an incident, or another sidecar replica
+// taking over) and reapplies them through the normal UpdateTargets
+// diffing/callback path, so consumers see a regular update rather than a
+// teardown/rebuild. Writes of this process's own that the store reports are
+// reapplied the same way. It also resyncs on SIGHUP so an
+// operator can force a reload on demand without sending a new file event.
+//
+// Watch blocks until ctx is canceled.
+func (t *TargetsManager) Watch(ctx context.Context) error {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	storeCh := t.store.Watch(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case info, ok := <-storeCh:
+			if !ok {
+				storeCh = nil
+				continue
+			}
+			if err := t.reload(info.Targets); err != nil {
+				t.log.Errorf("reload targets from store watch: %v", err)
+			}
+
+		case <-sighup:
+			info, err := t.store.Load(ctx)
+			if err != nil {
+				t.log.Errorf("reload targets on SIGHUP: %v", err)
+				continue
+			}
+			if err := t.reload(info.Targets); err != nil {
+				t.log.Errorf("apply targets on SIGHUP: %v", err)
+			}
+		}
+	}
+}
+
+func (t *TargetsManager) reload(targets map[string][]*target.Target) error {
+	return t.UpdateTargets(&shard.UpdateTargetsRequest{Targets: targets})
+}